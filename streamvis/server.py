@@ -3,7 +3,11 @@ import tornado
 import threading
 import signal
 import sys
+import json
+import logging
 import os
+import socket
+import ssl
 import fcntl
 import pickle
 import uuid
@@ -15,6 +19,39 @@ from tornado.ioloop import IOLoop
 from bokeh.server.server import Server as BokehServer
 from streamvis import util, plotstate, pagelayout
 
+log = logging.getLogger('streamvis.server')
+log_handler = logging.StreamHandler()
+
+class JsonFormatter(logging.Formatter):
+    def format(self, record):
+        msg = dict(time=self.formatTime(record), level=record.levelname,
+                name=record.name, message=record.getMessage())
+        if record.exc_info:
+            msg['exc_info'] = self.formatException(record.exc_info)
+        return json.dumps(msg)
+
+def init_logging(log_level, log_format):
+    """
+    Format all log records, including bokeh and tornado warnings, on stderr.
+
+    log_level: one of DEBUG, INFO, WARNING, ERROR for streamvis messages
+    log_format: 'text' or 'json' (one object per line)
+    """
+    level = logging.getLevelName(str(log_level).upper())
+    if not isinstance(level, int):
+        raise RuntimeError(f'Unknown {log_level=}')
+    if log_format == 'text':
+        formatter = logging.Formatter('%(asctime)s %(levelname)s %(name)s %(message)s')
+    elif log_format == 'json':
+        formatter = JsonFormatter()
+    else:
+        raise RuntimeError(f'{log_format=} must be one of \'text\' or \'json\'')
+    log_handler.setFormatter(formatter)
+    root = logging.getLogger()
+    if log_handler not in root.handlers:
+        root.addHandler(log_handler)
+    log.setLevel(level)
+
 class LockManager:
     def __init__(self):
         self.lock = threading.Lock()
@@ -49,6 +86,7 @@ class Server:
         self.is_pubsub = False
         self.write_log_fh = None
         self.read_log_fh = None
+        self.bad_record = None # (offset, file size) of last unreadable record
 
         self.page_lock = LockManager()
         self.pages = {}
@@ -86,7 +124,7 @@ class Server:
         if os.path.exists(read_log_path):
             try:
                 self.read_log_fh = open(read_log_path, 'rb')
-                print(f'Opened log file \'{read_log_path}\' for reading.')
+                log.info(f'Opened log file \'{read_log_path}\' for reading.')
             except OSError as ex:
                 raise RuntimeError(
                     f'{read_log_path=} could not be opened for reading: {ex}')
@@ -94,8 +132,8 @@ class Server:
         try:
             open(read_log_path, 'a').close()
             self.read_log_fh = open(read_log_path, 'rb')
-            print(f'Created new log file \'{read_log_path}\' opened for reading.')
-            print('Launch a client process to write to this file')
+            log.info(f'Created new log file \'{read_log_path}\' opened for reading.')
+            log.info('Launch a client process to write to this file')
         except OSError as ex:
             raise RuntimeError(
                 f'{read_log_path=} did not exist and couldn\'t be created: {ex}')
@@ -104,7 +142,7 @@ class Server:
         """
         Set up the server to use Pub/Sub.  
         """
-        print('Starting streamvis server...', flush=True)
+        log.info('Starting streamvis server...')
         from google.cloud import pubsub_v1
         self.is_pubsub = True
         self.project_id = project_id
@@ -134,18 +172,18 @@ class Server:
         sub = self.sub_client.subscribe(self.sub_path, callback=self.pubsub_callback)
         req = dict(subscription=self.sub_path, time='1970-01-01T00:00:00.00Z')
         self.sub_client.seek(req)
-        print(f'Created subscription: {subscription_id}')
+        log.info(f'Created subscription: {subscription_id}')
 
     def shutdown(self):
         if self.is_pubsub:
             from google.cloud import pubsub_v1
             self.sub_client.delete_subscription(request={'subscription': self.sub_path})
-            print(f'Deleted subscription {self.sub_path}')
+            log.info(f'Deleted subscription {self.sub_path}')
 
         if self.read_log_fh is not None:
             self.read_log_fh.close()
         if self.write_log_fh is not None:
-            print(f'Wrote {self.write_log_fh.tell()} bytes to write_log file '
+            log.info(f'Wrote {self.write_log_fh.tell()} bytes to write_log file '
                     f'{self.write_log_fh.name}')
             self.write_log_fh.close()
 
@@ -169,20 +207,41 @@ class Server:
     """
     async def logfile_callback(self):
         # don't want to block
+        def read_entry():
+            # returns the next log_entry, or None if there is no complete one yet.
+            # skips over corrupt data, such as a record torn by a crash, if a valid
+            # entry follows it.
+            offset = self.read_log_fh.tell()
+            try:
+                return pickle.load(self.read_log_fh)
+            except Exception as ex:
+                self.read_log_fh.seek(offset)
+                size = os.fstat(self.read_log_fh.fileno()).st_size
+                if offset == size or self.bad_record == (offset, size):
+                    return None
+                self.bad_record = (offset, size)
+                next_offset = util.resync(self.read_log_fh, offset)
+                if next_offset is None:
+                    log.debug(f'Incomplete record at offset {offset} of log file: {ex}')
+                    return None
+                log.warning(f'Skipped {next_offset - offset} bytes of corrupt data at '
+                        f'offset {offset} of log file: {ex}')
+                self.read_log_fh.seek(next_offset)
+                return read_entry()
+
         def update(state):
-            # runs while state is locked
-            while True:
+            # runs while state is locked.  returns number of entries read
+            num_entries = 0
+            while (log_entry := read_entry()) is not None:
                 try:
-                    log_entry = pickle.load(self.read_log_fh)
                     name = log_entry.plot_name
                     plot_state = state.setdefault(name, plotstate.PlotState(name))
                     plot_state.update(log_entry)
-                except EOFError:
-                    break
+                    num_entries += 1
                 except Exception as ex:
-                    print(f'Could not process log_entry from log file: {ex}',
-                            file=sys.stderr)
+                    log.error(f'Could not process log_entry from log file: {ex}')
                     sys.exit(1)
+            return num_entries
 
         while True:
             await asyncio.sleep(1)
@@ -190,8 +249,11 @@ class Server:
                 if locked_state is None:
                     continue
                 fcntl.flock(self.read_log_fh, fcntl.LOCK_EX)
-                update(locked_state)
+                num_entries = update(locked_state)
                 fcntl.flock(self.read_log_fh, fcntl.LOCK_UN)
+                if num_entries > 0:
+                    log.debug(f'Read {num_entries} log entries, now at offset '
+                            f'{self.read_log_fh.tell()}')
 
             with self.page_lock:
                 self.update_pending = True
@@ -221,7 +283,7 @@ class Server:
         try:
             log_entry = util.LogEntry.from_pubsub_message(message)
         except Exception as ex:
-            print('Could not create log_entry from pubsub message: {ex}', file=sys.stderr)
+            log.warning(f'Could not create log_entry from pubsub message: {ex}')
             return
 
         with self.get_state(blocking=True) as state:
@@ -230,8 +292,8 @@ class Server:
             try:
                 plot_state.update(log_entry)
             except Exception as ex:
-                print(f'Could not process log_entry from pubsub message: {ex}.  Skipping.',
-                        file=sys.stderr)
+                log.warning(f'Could not process log_entry from pubsub message: {ex}.  '
+                        f'Skipping.')
                 return
 
         if self.write_log_fh is not None:
@@ -254,6 +316,9 @@ class Server:
         """
         req = doc.session_context.request
         session_id = doc.session_context.id
+        args = {k: [v.decode(errors='replace') for v in vs]
+                for k, vs in req.arguments.items()}
+        log.info(f'New page session {session_id} with arguments {args}')
 
         if len(req.arguments) == 0:
             page = pagelayout.IndexPage(self, doc)
@@ -265,13 +330,22 @@ class Server:
         with self.page_lock:
             self.pages[session_id] = page
 
-def make_server(port, run_name, project, topic, read_log_path, write_log_path):
+def make_server(port, run_name, project, topic, read_log_path, write_log_path,
+        host='localhost', allow_origin=None, ssl_certfile=None, ssl_keyfile=None,
+        log_level='INFO', log_format='text'):
     """
     port: webserver port
     run_name: arbitrary name for this
     project: Google Cloud Platform project id with Pub/Sub API enabled
     topic: Pub/Sub topic for client/server communication.
+    host: address to bind the webserver to
+    allow_origin: extra host[:port] origins browsers may connect from
+    ssl_certfile: PEM certificate chain; serves https if provided
+    ssl_keyfile: PEM private key, if not included in ssl_certfile
+    log_level: minimum level of server log messages
+    log_format: 'text' or 'json'
     """
+    init_logging(log_level, log_format)
     sv_server = Server(run_name)
     if project is None and read_log_path is None:
         raise RuntimeError(
@@ -284,6 +358,20 @@ def make_server(port, run_name, project, topic, read_log_path, write_log_path):
         raise RuntimeError(
             f'`write_log_path` and `read_log_path` cannot both be provided. '
             f'Received {write_log_path=}, {read_log_path=}')
+    if ssl_keyfile and not ssl_certfile:
+        raise RuntimeError(
+            f'`ssl_keyfile` requires `ssl_certfile`.  Received {ssl_keyfile=}')
+    if ssl_certfile:
+        # load the certificate now, so bad paths fail before any subscription exists
+        try:
+            ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER).load_cert_chain(
+                    ssl_certfile, ssl_keyfile)
+        except (OSError, ssl.SSLError) as ex:
+            raise RuntimeError(
+                f'Could not load TLS certificate {ssl_certfile=}, {ssl_keyfile=}: '
+                f'{ex}')
+    origins, exposed = util.websocket_origins(host, port)
+    origins += [o for o in util.parse_origins(allow_origin) if o not in origins]
 
     loop = asyncio.new_event_loop()
     asyncio.set_event_loop(loop)
@@ -302,7 +390,7 @@ def make_server(port, run_name, project, topic, read_log_path, write_log_path):
     loop.create_task(sv_server.update_pages())
 
     def shutdown_handler(signum, frame):
-        print(f'Server received {signal.Signals(signum).name}')
+        log.info(f'Server received {signal.Signals(signum).name}')
         sv_server.shutdown()
 
     signal.signal(signal.SIGQUIT, shutdown_handler)
@@ -311,14 +399,48 @@ def make_server(port, run_name, project, topic, read_log_path, write_log_path):
     handler = FunctionHandler(sv_server.add_page)
     cleanup = CleanupHandler(sv_server)
     bokeh_app = Application(handler, cleanup)
-    bsrv = BokehServer({'/': bokeh_app}, port=port, io_loop=loop_wrap)
-
-    print(f'Web server is running on http://localhost:{port}')
+    if exposed:
+        log.warning(f'Serving on {host=} with no authentication.  Anyone who can '
+                f'reach port {port} can view the data.  Browsers must connect via an '
+                f'allowed origin; add others with --allow_origin.')
+    log.info(f'Allowed browser origins: {", ".join(origins)}')
+
+    bsrv = BokehServer({'/': bokeh_app}, port=port, address=host, io_loop=loop_wrap,
+            allow_websocket_origin=origins, ssl_certfile=ssl_certfile,
+            ssl_keyfile=ssl_keyfile)
+
+    scheme = 'https' if ssl_certfile else 'http'
+    addr, wildcard, _ = util.classify_host(host)
+    if wildcard:
+        log.info(f'Web server is running on all interfaces, port {port}.  Browse to '
+                f'{scheme}://{socket.gethostname()}:{port}')
+    elif addr is not None and addr.version == 6:
+        log.info(f'Web server is running on {scheme}://[{host}]:{port}')
+    else:
+        log.info(f'Web server is running on {scheme}://{host}:{port}')
     bsrv.run_until_shutdown()
 
+def merge_options(required, config, **kwargs):
+    """
+    Merge command line options `kwargs` over those in the yaml `config` file.
+    Options not given on the command line (None) are taken from the file.
+    """
+    opts = {} if config is None else util.load_config(config, kwargs.keys())
+    opts.update({k: v for k, v in kwargs.items() if v is not None})
+    missing = [k for k in required if k not in opts]
+    if missing:
+        raise RuntimeError(
+            f'Missing required options {missing}.  Provide them on the command '
+            f'line or in the --config file')
+    return opts
+
 def run():
     import fire
-    def file(port: int, run_name: str, log_file_path: str):
+
+    def file(port: int =None, run_name: str =None, log_file_path: str =None,
+            host: str =None, allow_origin: str =None, ssl_certfile: str =None,
+            ssl_keyfile: str =None, log_level: str =None, log_format: str =None,
+            config: str =None):
         """
         Visualize data from `log_file_path`
 
@@ -328,10 +450,26 @@ def run():
                               visualized.  File may be produced by a previous server run 
                               in `pubsub` mode, or produced by a previous run of the 
                               streamvis client.
+        :param host: address to bind the webserver to (default localhost).  Use
+                     0.0.0.0 to serve on all interfaces
+        :param allow_origin: comma-separated host[:port] origins browsers may also
+                             connect from, e.g. a proxy or tunnel address
+        :param ssl_certfile: PEM certificate chain.  Serve https if provided
+        :param ssl_keyfile: PEM private key, if not included in ssl_certfile
+        :param log_level: DEBUG, INFO (default), WARNING or ERROR
+        :param log_format: 'text' (default) or 'json' (one JSON object per line)
+        :param config: yaml file setting any of the options above by name.  Options
+                       given on the command line take precedence
         """
-        return make_server(port, run_name, None, None, log_file_path, None)
-
-    def pubsub(port: int, run_name: str, project: str, topic: str, log_file: str =None):
+        opts = merge_options(('port', 'run_name', 'log_file_path'), **locals())
+        read_log_path = opts.pop('log_file_path')
+        return make_server(project=None, topic=None, read_log_path=read_log_path,
+                write_log_path=None, **opts)
+
+    def pubsub(port: int =None, run_name: str =None, project: str =None,
+            topic: str =None, log_file: str =None, host: str =None,
+            allow_origin: str =None, ssl_certfile: str =None, ssl_keyfile: str =None,
+            log_level: str =None, log_format: str =None, config: str =None):
         """
         Visualize data from pubsub subscription
 
@@ -341,8 +479,20 @@ def run():
         :param topic: GCP Pub/Sub topic id.  Must already exist.  Create with gcloud
                       or GCP console.
         :param log_file: path to local file to log all received data if provided
+        :param host: address to bind the webserver to (default localhost).  Use
+                     0.0.0.0 to serve on all interfaces
+        :param allow_origin: comma-separated host[:port] origins browsers may also
+                             connect from, e.g. a proxy or tunnel address
+        :param ssl_certfile: PEM certificate chain.  Serve https if provided
+        :param ssl_keyfile: PEM private key, if not included in ssl_certfile
+        :param log_level: DEBUG, INFO (default), WARNING or ERROR
+        :param log_format: 'text' (default) or 'json' (one JSON object per line)
+        :param config: yaml file setting any of the options above by name.  Options
+                       given on the command line take precedence
         """
-        return make_server(port, run_name, project, topic, None, log_file)
+        opts = merge_options(('port', 'run_name', 'project', 'topic'), **locals())
+        write_log_path = opts.pop('log_file', None)
+        return make_server(read_log_path=None, write_log_path=write_log_path, **opts)
 
     cmds = dict(file=file, pubsub=pubsub)
     fire.Fire(cmds)
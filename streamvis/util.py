@@ -1,4 +1,8 @@
+import io
 import pickle
+import ipaddress
+import re
+import socket
 
 def topic_exists(pub_client, project, topic):
     """
@@ -8,6 +12,130 @@ def topic_exists(pub_client, project, topic):
     topic_path = pub_client.topic_path(project, topic)
     return topic_path in gen
 
+def classify_host(host):
+    """
+    Classify the webserver bind address `host`.  Returns (addr, wildcard, loopback)
+    where addr is the ipaddress object, or None if `host` is a hostname.
+    """
+    try:
+        addr = ipaddress.ip_address(host)
+    except ValueError:
+        return None, host == '', host.lower() == 'localhost'
+    return addr, addr.is_unspecified, addr.is_loopback
+
+def local_addresses():
+    """
+    IPv4 addresses of this machine: those its hostname resolves to, and the source
+    address of the default route.
+    """
+    addrs = []
+    try:
+        infos = socket.getaddrinfo(socket.gethostname(), None, socket.AF_INET)
+        addrs += [info[4][0] for info in infos]
+    except OSError:
+        pass
+    try:
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as sock:
+            # connecting a UDP socket sends nothing, it only picks the route
+            sock.connect(('10.255.255.255', 1))
+            addrs.append(sock.getsockname()[0])
+    except OSError:
+        pass
+    return list(dict.fromkeys(addrs))
+
+def websocket_origins(host, port):
+    """
+    Returns (origins, exposed) for a webserver bound to `host`:
+
+    origins: 'host:port' values for Bokeh's allow_websocket_origin
+    exposed: True if `host` is reachable from other machines
+
+    Bokeh splits each origin on ':', so IPv6 literals can't be listed.  For those,
+    and for wildcard binds, the machine's own hostnames are used instead.  Wildcard
+    binds also allow the machine's IPv4 addresses.
+    """
+    addr, wildcard, loopback = classify_host(host)
+    hosts = []
+    if wildcard or loopback:
+        hosts.append('localhost')
+    if not wildcard and (addr is None or addr.version == 4):
+        hosts.append(host.lower())
+    elif not loopback:
+        hosts += [socket.gethostname().lower(), socket.getfqdn().lower()]
+    if wildcard:
+        hosts += local_addresses()
+
+    origins = [f'{h}:{port}' for h in dict.fromkeys(hosts)]
+    return origins, not loopback
+
+def parse_origins(allow_origin):
+    """
+    Parse `allow_origin`, a comma-separated string or a list of host[:port] values,
+    into a list for Bokeh's allow_websocket_origin.
+    """
+    if allow_origin is None:
+        return []
+    if isinstance(allow_origin, str):
+        allow_origin = allow_origin.split(',')
+    origins = []
+    for origin in allow_origin:
+        origin = str(origin).strip()
+        if origin == '':
+            continue
+        if '://' in origin:
+            raise RuntimeError(
+                f'allow_origin {origin!r} must not include a scheme.  Give it as '
+                f'host[:port], e.g. {origin.split("://", 1)[1].rstrip("/")!r}')
+        if not re.fullmatch(r'[\w.*-]+(:\d+)?', origin):
+            raise RuntimeError(
+                f'allow_origin {origin!r} is not of the form host[:port]')
+        origins.append(origin)
+    return origins
+
+def load_config(path, allowed):
+    """
+    Load server options from the yaml file at `path`.  The file must be a mapping
+    whose keys are a subset of `allowed` option names.
+    """
+    import yaml
+    try:
+        with open(path) as fh:
+            config = yaml.safe_load(fh)
+    except (OSError, yaml.YAMLError) as ex:
+        raise RuntimeError(f'Could not load config file {path=}: {ex}')
+    if config is None:
+        return {}
+    if not isinstance(config, dict):
+        raise RuntimeError(
+            f'Config file {path=} must be a mapping of option names to values. '
+            f'Got {type(config).__name__}')
+    unknown = set(config) - set(allowed)
+    if unknown:
+        raise RuntimeError(
+            f'Config file {path=} has unknown options {sorted(unknown)}.  '
+            f'Allowed options are {sorted(allowed)}')
+    return config
+
+def resync(fh, offset):
+    """
+    Find the next pickled LogEntry in `fh` after the unreadable data at `offset`.
+    Returns its offset, or None if no complete entry follows.  Leaves `fh` at
+    `offset`.
+    """
+    fh.seek(offset)
+    data = fh.read()
+    fh.seek(offset)
+    # every pickle of protocol 2 or later starts with the PROTO opcode
+    pos = data.find(pickle.PROTO, 1)
+    while pos != -1:
+        try:
+            if isinstance(pickle.load(io.BytesIO(data[pos:])), LogEntry):
+                return offset + pos
+        except Exception:
+            pass
+        pos = data.find(pickle.PROTO, pos + 1)
+    return None
+
 class LogEntry:
     """
     Represents the base unit communicated from the client